@@ -0,0 +1,72 @@
+// flashattn_capability.go
+
+package llm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ollama/ollama/discover"
+)
+
+// flashAttentionHeadDims lists the head dimensions flash attention kernels
+// are compiled for across backends.
+var flashAttentionHeadDims = []uint64{64, 80, 96, 112, 128, 256}
+
+// flashAttentionCapability describes the constraints a GPU backend places
+// on flash attention support, beyond the shared head-dim check.
+type flashAttentionCapability struct {
+	// minDriverMajor is the minimum driver major version required, or 0 if
+	// the backend doesn't gate on driver version.
+	minDriverMajor int
+	// minGfxArch is the minimum ROCm gfx architecture number required
+	// (e.g. 1030 for gfx1030), or 0 if not applicable.
+	minGfxArch int
+}
+
+// flashAttentionBackends maps a discover.GpuInfo's Library to the
+// constraints that backend's flash attention kernels impose.
+var flashAttentionBackends = map[string]flashAttentionCapability{
+	"cuda":   {minDriverMajor: 7},
+	"rocm":   {minGfxArch: 1030},
+	"metal":  {},
+	"vulkan": {},
+	"cpu":    {},
+}
+
+// gpuSupportsFlashAttention checks a single GPU's backend-specific flash
+// attention constraints, returning a human-readable reason when the GPU
+// doesn't support it.
+func gpuSupportsFlashAttention(gpu discover.GpuInfo) (bool, string) {
+	capability, ok := flashAttentionBackends[gpu.Library]
+	if !ok {
+		return false, fmt.Sprintf("backend %q has no flash attention kernels", gpu.Library)
+	}
+
+	if capability.minDriverMajor > 0 && gpu.DriverMajor < capability.minDriverMajor {
+		return false, fmt.Sprintf("%s driver %d.%d is older than the minimum required %d.0",
+			gpu.Library, gpu.DriverMajor, gpu.DriverMinor, capability.minDriverMajor)
+	}
+
+	if capability.minGfxArch > 0 {
+		arch := gpuGfxArch(gpu)
+		if arch == 0 || arch < capability.minGfxArch {
+			return false, fmt.Sprintf("%s architecture %q is older than the minimum required gfx%d",
+				gpu.Library, gpu.Variant, capability.minGfxArch)
+		}
+	}
+
+	return true, ""
+}
+
+// gpuGfxArch parses the numeric ROCm gfx architecture (e.g. 1030 from
+// "gfx1030") out of a GpuInfo's Variant, returning 0 if it can't be parsed.
+func gpuGfxArch(gpu discover.GpuInfo) int {
+	arch := strings.TrimPrefix(strings.ToLower(gpu.Variant), "gfx")
+	n, err := strconv.Atoi(arch)
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,37 @@
+package llm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ollama/ollama/discover"
+)
+
+func TestGpuSupportsFlashAttention(t *testing.T) {
+	tests := []struct {
+		name string
+		gpu  discover.GpuInfo
+		want bool
+	}{
+		{name: "cuda new enough driver", gpu: discover.GpuInfo{Library: "cuda", DriverMajor: 8}, want: true},
+		{name: "cuda too old driver", gpu: discover.GpuInfo{Library: "cuda", DriverMajor: 6}, want: false},
+		{name: "rocm new enough gfx arch", gpu: discover.GpuInfo{Library: "rocm", Variant: "gfx1100"}, want: true},
+		{name: "rocm too old gfx arch", gpu: discover.GpuInfo{Library: "rocm", Variant: "gfx900"}, want: false},
+		{name: "rocm unparseable variant", gpu: discover.GpuInfo{Library: "rocm", Variant: ""}, want: false},
+		{name: "metal always supported", gpu: discover.GpuInfo{Library: "metal"}, want: true},
+		{name: "vulkan always supported", gpu: discover.GpuInfo{Library: "vulkan"}, want: true},
+		{name: "cpu always supported", gpu: discover.GpuInfo{Library: "cpu"}, want: true},
+		{name: "unknown backend", gpu: discover.GpuInfo{Library: "oneapi"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := gpuSupportsFlashAttention(tt.gpu)
+			assert.Equal(t, tt.want, got)
+			if !tt.want {
+				assert.NotEmpty(t, reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+// kvcache_estimate.go
+
+package llm
+
+import (
+	"log/slog"
+	"slices"
+)
+
+// kvCacheDowngradeLadder is the order in which quantized cache types are
+// tried when the requested type doesn't fit in the available VRAM, from
+// cheapest to priciest by BytesPerElem. f16 isn't part of the ladder:
+// fitCacheType leaves it as requested, and when nothing on the ladder fits
+// it returns the cheapest ladder entry. Every RequiresFlashAttn type in the
+// registry belongs here, or fitCacheType silently leaves it un-downgraded
+// when it doesn't fit.
+var kvCacheDowngradeLadder = []string{"iq2_xxs", "iq3_s", "q4_0", "iq4_nl", "q4_1", "q5_0", "q5_1", "q6_K", "q8_0"}
+
+// EstimateKVCacheBytes projects the KV cache footprint for the given model,
+// context length, cache type, and number of parallel sequences.
+func EstimateKVCacheBytes(ggml GGMLModel, ctxLen int, cacheType string, parallel int) uint64 {
+	headCountK := ggml.KV().EmbeddingHeadCountK()
+	headCountV := ggml.KV().EmbeddingHeadCountV()
+	headCountKV := ggml.KV().HeadCountKV()
+	layerCount := ggml.KV().BlockCount()
+	if headCountK == 0 || headCountV == 0 || headCountKV == 0 || layerCount == 0 || ctxLen <= 0 {
+		return 0
+	}
+
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	bytesPerElem := float64(2) // f16 default
+	if ct, ok := LookupCacheType(cacheType); ok {
+		bytesPerElem = float64(ct.BytesPerElem)
+	}
+
+	// EmbeddingHeadCountK/V return the per-head K/V dimension, not the
+	// number of KV attention heads - without multiplying by headCountKV
+	// this undercounts the real footprint by that factor for every
+	// GQA/MHA model.
+	perToken := float64(headCountK+headCountV) * bytesPerElem * float64(headCountKV)
+	return uint64(perToken * float64(ctxLen) * float64(parallel) * float64(layerCount))
+}
+
+// fitCacheType walks the downgrade ladder backwards from cacheType toward
+// its cheapest end (iq2_xxs) until the estimated footprint fits within
+// freeBytes. Cache types outside the ladder (f16, f32, bf16) aren't
+// downgraded, since they're the model-mandated or unquantized defaults,
+// not part of the quantized range this ladder covers.
+func fitCacheType(ggml GGMLModel, cacheType string, ctxLen, parallel int, freeBytes uint64) string {
+	idx := slices.Index(kvCacheDowngradeLadder, cacheType)
+	if idx == -1 {
+		return cacheType
+	}
+
+	for i := idx; i >= 0; i-- {
+		candidate := kvCacheDowngradeLadder[i]
+		estimate := EstimateKVCacheBytes(ggml, ctxLen, candidate, parallel)
+		if estimate == 0 || estimate <= freeBytes {
+			if candidate != cacheType {
+				slog.Warn("KV cache type downgraded to fit available memory",
+					"requested", cacheType, "selected", candidate, "estimated_bytes", estimate, "free_bytes", freeBytes)
+			}
+			return candidate
+		}
+	}
+
+	return kvCacheDowngradeLadder[0]
+}
@@ -0,0 +1,102 @@
+package llm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testEstimatorGGML() *testGGML {
+	return &testGGML{kv: map[string]any{
+		"general.architecture":          "llama",
+		"llama.attention.key_length":    uint32(128),
+		"llama.attention.value_length":  uint32(128),
+		"llama.attention.head_count_kv": uint32(8),
+		"llama.block_count":             uint32(32),
+	}}
+}
+
+func TestEstimateKVCacheBytes(t *testing.T) {
+	ggml := testEstimatorGGML()
+
+	f16 := EstimateKVCacheBytes(ggml, 4096, "f16", 1)
+	q4_0 := EstimateKVCacheBytes(ggml, 4096, "q4_0", 1)
+
+	assert.Greater(t, f16, uint64(0))
+	assert.Less(t, q4_0, f16, "q4_0 should use less memory than f16")
+
+	doubleParallel := EstimateKVCacheBytes(ggml, 4096, "f16", 2)
+	assert.Equal(t, f16*2, doubleParallel)
+}
+
+func TestEstimateKVCacheBytesScalesWithHeadCountKV(t *testing.T) {
+	// (headDimK+headDimV) * bytesPerElem * headCountKV * ctxLen * parallel * layerCount
+	ggml := testEstimatorGGML()
+
+	got := EstimateKVCacheBytes(ggml, 4096, "f16", 1)
+	want := uint64((128 + 128) * 2 * 8 * 4096 * 1 * 32)
+	assert.Equal(t, want, got, "headCountKV must be folded in, not just the per-head K/V dimensions")
+}
+
+func TestFitCacheType(t *testing.T) {
+	ggml := testEstimatorGGML()
+
+	tests := []struct {
+		name      string
+		cacheType string
+		freeBytes uint64
+		want      string
+	}{
+		{
+			name:      "requested type fits, no downgrade",
+			cacheType: "q8_0",
+			freeBytes: EstimateKVCacheBytes(ggml, 4096, "q8_0", 1),
+			want:      "q8_0",
+		},
+		{
+			name:      "requested type too large, walks the downgrade ladder",
+			cacheType: "q8_0",
+			freeBytes: EstimateKVCacheBytes(ggml, 4096, "q5_0", 1),
+			want:      "q5_0",
+		},
+		{
+			name:      "nothing fits, bottoms out at the cheapest type on the ladder",
+			cacheType: "q4_1",
+			freeBytes: 0,
+			want:      "iq2_xxs",
+		},
+		{
+			name:      "q6_K too large, walks down to q5_1",
+			cacheType: "q6_K",
+			freeBytes: EstimateKVCacheBytes(ggml, 4096, "q5_1", 1),
+			want:      "q5_1",
+		},
+		{
+			name:      "iq3_s and iq2_xxs are on the ladder and can be downgraded further",
+			cacheType: "iq3_s",
+			freeBytes: 0,
+			want:      "iq2_xxs",
+		},
+		{
+			name:      "type outside the ladder is left untouched",
+			cacheType: "f32",
+			freeBytes: 0,
+			want:      "f32",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fitCacheType(ggml, tt.cacheType, 4096, 1, tt.freeBytes)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFitCacheTypeEmbeddingModelUnaffected(t *testing.T) {
+	// Embedding models are restricted to f32/f16/bf16 by ValidateKVCacheType
+	// before fitCacheType ever runs, so f16 should never be downgraded.
+	ggml := testEstimatorGGML()
+	got := fitCacheType(ggml, "f16", 4096, 1, 0)
+	assert.Equal(t, "f16", got)
+}
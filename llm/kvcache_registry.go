@@ -0,0 +1,143 @@
+// kvcache_registry.go
+
+package llm
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ollama/ollama/discover"
+)
+
+// CacheType describes a KV cache quantization format and the constraints
+// llama.cpp places on where it can be used.
+type CacheType struct {
+	Name string
+
+	// BytesPerElem is the approximate per-element memory cost of this
+	// type, used by EstimateKVCacheBytes.
+	BytesPerElem float32
+
+	// RequiresFlashAttn is true when llama.cpp requires flash attention
+	// to be enabled in order to use this cache type.
+	RequiresFlashAttn bool
+
+	// AllowedForEmbedding is true for the types embedding models are
+	// permitted to use (f32, f16, bf16).
+	AllowedForEmbedding bool
+
+	// MinBackend maps a GPU Library (e.g. "cuda", "rocm") to the minimum
+	// driver/runtime version string required to use this cache type on
+	// that backend. Only the major version number is compared. Nil or
+	// missing entries mean no backend-specific minimum is enforced.
+	MinBackend map[string]string
+}
+
+var (
+	cacheTypesMu sync.RWMutex
+	cacheTypes   = map[string]CacheType{}
+)
+
+func init() {
+	for _, ct := range []CacheType{
+		{Name: "f32", BytesPerElem: 4, AllowedForEmbedding: true},
+		{Name: "f16", BytesPerElem: 2, AllowedForEmbedding: true},
+		{Name: "bf16", BytesPerElem: 2, AllowedForEmbedding: true, MinBackend: map[string]string{"cuda": "12"}},
+		{Name: "q8_0", BytesPerElem: 1.0625, RequiresFlashAttn: true},
+		{Name: "q6_K", BytesPerElem: 0.8125, RequiresFlashAttn: true},
+		{Name: "q5_1", BytesPerElem: 0.75, RequiresFlashAttn: true},
+		{Name: "q5_0", BytesPerElem: 0.6875, RequiresFlashAttn: true},
+		{Name: "iq4_nl", BytesPerElem: 0.5625, RequiresFlashAttn: true},
+		{Name: "q4_1", BytesPerElem: 0.625, RequiresFlashAttn: true},
+		{Name: "q4_0", BytesPerElem: 0.5625, RequiresFlashAttn: true},
+		{Name: "iq3_s", BytesPerElem: 0.4375, RequiresFlashAttn: true, MinBackend: map[string]string{"cuda": "12"}},
+		{Name: "iq2_xxs", BytesPerElem: 0.25, RequiresFlashAttn: true, MinBackend: map[string]string{"cuda": "12"}},
+	} {
+		RegisterCacheType(ct)
+	}
+}
+
+// RegisterCacheType adds or overrides a cache type's constraints in the
+// registry, letting downstream forks add experimental quant formats
+// without editing core validation.
+func RegisterCacheType(ct CacheType) {
+	cacheTypesMu.Lock()
+	defer cacheTypesMu.Unlock()
+	cacheTypes[ct.Name] = ct
+}
+
+// LookupCacheType returns the registered CacheType for name, if any.
+func LookupCacheType(name string) (CacheType, bool) {
+	cacheTypesMu.RLock()
+	defer cacheTypesMu.RUnlock()
+	ct, ok := cacheTypes[name]
+	return ct, ok
+}
+
+// cacheTypeRequiresFlashAttn reports whether name is a registered cache
+// type that requires flash attention. An unregistered name is treated as
+// not requiring it, since ValidateKVCacheType rejects it down to f16.
+func cacheTypeRequiresFlashAttn(name string) bool {
+	ct, ok := LookupCacheType(name)
+	return ok && ct.RequiresFlashAttn
+}
+
+// cacheTypeSupportedOnBackend checks name's MinBackend constraint (if any)
+// against a single GPU's Library and driver version, the same way
+// flashattn_capability.go gates flash attention per backend.
+func cacheTypeSupportedOnBackend(name string, gpu discover.GpuInfo) (bool, string) {
+	ct, ok := LookupCacheType(name)
+	if !ok || ct.MinBackend == nil {
+		return true, ""
+	}
+
+	minVersion, ok := ct.MinBackend[gpu.Library]
+	if !ok {
+		return true, ""
+	}
+
+	minMajor := parseMajorVersion(minVersion)
+	if minMajor > 0 && gpu.DriverMajor < minMajor {
+		return false, fmt.Sprintf("%s cache type requires %s driver %s+, found %d.%d",
+			name, gpu.Library, minVersion, gpu.DriverMajor, gpu.DriverMinor)
+	}
+
+	return true, ""
+}
+
+// parseMajorVersion extracts the leading major version number from a
+// version string like "12" or "12.0", returning 0 if it can't be parsed.
+func parseMajorVersion(v string) int {
+	major, _, _ := strings.Cut(v, ".")
+	n, err := strconv.Atoi(major)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// validateCacheTypeForBackends downgrades name to f16 if any of gpus
+// fails its MinBackend constraint, warning with the reason.
+func validateCacheTypeForBackends(name string, gpus discover.GpuInfoList) string {
+	for _, gpu := range gpus {
+		if ok, reason := cacheTypeSupportedOnBackend(name, gpu); !ok {
+			slog.Warn("cache type not supported by backend, defaulting to f16", "type", name, "reason", reason)
+			return "f16"
+		}
+	}
+	return name
+}
+
+// ValidKVCacheTypeNames returns the names of every registered cache type.
+func ValidKVCacheTypeNames() []string {
+	cacheTypesMu.RLock()
+	defer cacheTypesMu.RUnlock()
+	names := make([]string, 0, len(cacheTypes))
+	for name := range cacheTypes {
+		names = append(names, name)
+	}
+	return names
+}
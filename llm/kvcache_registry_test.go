@@ -0,0 +1,83 @@
+package llm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ollama/ollama/discover"
+)
+
+func TestLookupCacheType(t *testing.T) {
+	ct, ok := LookupCacheType("bf16")
+	assert.True(t, ok)
+	assert.True(t, ct.AllowedForEmbedding)
+	assert.False(t, ct.RequiresFlashAttn)
+
+	ct, ok = LookupCacheType("q4_0")
+	assert.True(t, ok)
+	assert.False(t, ct.AllowedForEmbedding)
+	assert.True(t, ct.RequiresFlashAttn)
+
+	_, ok = LookupCacheType("not_a_real_type")
+	assert.False(t, ok)
+}
+
+func TestRegisterCacheType(t *testing.T) {
+	RegisterCacheType(CacheType{Name: "iq1_m_test", BytesPerElem: 0.1875, RequiresFlashAttn: true})
+
+	ct, ok := LookupCacheType("iq1_m_test")
+	assert.True(t, ok)
+	assert.Equal(t, float32(0.1875), ct.BytesPerElem)
+
+	validated, err := ValidateKVCacheType("iq1_m_test", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "iq1_m_test", validated)
+}
+
+func TestValidateKVCacheTypeUsesRegistryConstraints(t *testing.T) {
+	RegisterCacheType(CacheType{Name: "embeddable_test", BytesPerElem: 2, AllowedForEmbedding: true})
+	RegisterCacheType(CacheType{Name: "quantized_test", BytesPerElem: 0.5, RequiresFlashAttn: true})
+
+	got, err := ValidateKVCacheType("embeddable_test", true)
+	assert.NoError(t, err)
+	assert.Equal(t, "embeddable_test", got)
+
+	got, err = ValidateKVCacheType("quantized_test", true)
+	assert.NoError(t, err)
+	assert.Equal(t, "f16", got, "embedding models must fall back to f16 for types not marked AllowedForEmbedding")
+}
+
+func TestCacheTypeSupportedOnBackend(t *testing.T) {
+	RegisterCacheType(CacheType{Name: "backend_gated_test", BytesPerElem: 2, MinBackend: map[string]string{"cuda": "12"}})
+
+	tests := []struct {
+		name string
+		gpu  discover.GpuInfo
+		want bool
+	}{
+		{name: "new enough cuda driver", gpu: discover.GpuInfo{Library: "cuda", DriverMajor: 12}, want: true},
+		{name: "too old cuda driver", gpu: discover.GpuInfo{Library: "cuda", DriverMajor: 11}, want: false},
+		{name: "unconstrained backend", gpu: discover.GpuInfo{Library: "metal"}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := cacheTypeSupportedOnBackend("backend_gated_test", tt.gpu)
+			assert.Equal(t, tt.want, got)
+			if !tt.want {
+				assert.NotEmpty(t, reason)
+			}
+		})
+	}
+}
+
+func TestValidateCacheTypeForBackendsDowngrades(t *testing.T) {
+	RegisterCacheType(CacheType{Name: "backend_gated_test2", BytesPerElem: 2, MinBackend: map[string]string{"cuda": "12"}})
+
+	got := validateCacheTypeForBackends("backend_gated_test2", discover.GpuInfoList{{Library: "cuda", DriverMajor: 11}})
+	assert.Equal(t, "f16", got)
+
+	got = validateCacheTypeForBackends("backend_gated_test2", discover.GpuInfoList{{Library: "cuda", DriverMajor: 12}})
+	assert.Equal(t, "backend_gated_test2", got)
+}
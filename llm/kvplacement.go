@@ -0,0 +1,218 @@
+// kvplacement.go
+
+package llm
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/ollama/ollama/discover"
+)
+
+// KVPlacementMode selects the strategy used to place per-layer KV cache
+// tensors across the available devices.
+type KVPlacementMode string
+
+const (
+	KVPlacementAuto   KVPlacementMode = "auto"
+	KVPlacementAllGPU KVPlacementMode = "all-gpu"
+	KVPlacementAllCPU KVPlacementMode = "all-cpu"
+	KVPlacementCustom KVPlacementMode = "custom"
+)
+
+// KVPlacement describes how a caller wants per-layer KV cache tensors
+// placed across GPU and host memory, mirroring llama.cpp's per-layer KV
+// offload support.
+type KVPlacement struct {
+	Mode KVPlacementMode
+
+	// CustomLayers lists the layer indices to keep on GPU. Only used when
+	// Mode is KVPlacementCustom.
+	CustomLayers []int
+
+	// KeepAttentionLayersOnDevice prioritizes the last layers (where
+	// attention dominates KV traffic) for GPU placement when only a
+	// partial offload fits.
+	KeepAttentionLayersOnDevice bool
+}
+
+// KVPlacementPlan is the resolved outcome of a KVPlacement policy: which
+// layers live on GPU vs host, and whether a Device->Host copy fallback is
+// required because only a partial offload fit in the available VRAM.
+type KVPlacementPlan struct {
+	GPULayers      []int
+	CPULayers      []int
+	PartialOffload bool
+}
+
+// ComputeKVPlacementPlan resolves a KVPlacement policy into a concrete
+// per-layer plan, using gpus' free VRAM and the model's layer count,
+// head dimensions, and per-layer weight size - scaled by the requested
+// context length and parallel sequence count - to decide how many
+// layers' weights and KV cache can fit on device.
+func ComputeKVPlacementPlan(ggml GGMLModel, gpus discover.GpuInfoList, policy KVPlacement, numCtx, parallel int) KVPlacementPlan {
+	layerCount := int(ggml.KV().BlockCount())
+
+	switch policy.Mode {
+	case KVPlacementAllCPU:
+		slog.Info("KV placement: all-cpu requested", "layers", layerCount)
+		return allCPUPlan(layerCount)
+	case KVPlacementCustom:
+		return customKVPlan(layerCount, policy.CustomLayers)
+	case KVPlacementAllGPU:
+		if len(gpus) == 0 {
+			slog.Warn("KV placement: all-gpu requested but no GPUs detected, falling back to all-cpu")
+			return allCPUPlan(layerCount)
+		}
+		slog.Info("KV placement: all-gpu requested", "layers", layerCount)
+		return allGPUPlan(layerCount)
+	default:
+		return autoKVPlan(ggml, gpus, layerCount, numCtx, parallel, policy.KeepAttentionLayersOnDevice)
+	}
+}
+
+func autoKVPlan(ggml GGMLModel, gpus discover.GpuInfoList, layerCount, numCtx, parallel int, keepAttentionLayersOnDevice bool) KVPlacementPlan {
+	if len(gpus) == 0 {
+		slog.Info("KV placement: no GPUs detected, placing all layers on host")
+		return allCPUPlan(layerCount)
+	}
+
+	freeBytes := smallestFreeMemory(gpus)
+	// A layer's device footprint is its weights plus its KV cache, not
+	// the KV cache alone - the weights dominate in practice, so omitting
+	// them would report far more layers fitting than actually do.
+	perLayer := ggml.LayerWeightBytes() + perLayerKVBytes(ggml, numCtx, parallel)
+	if perLayer == 0 {
+		slog.Warn("KV placement: unable to estimate per-layer footprint, defaulting to all-gpu")
+		return allGPUPlan(layerCount)
+	}
+
+	fitLayers := int(freeBytes / perLayer)
+	if fitLayers >= layerCount {
+		slog.Info("KV placement: all layers fit on device", "layers", layerCount, "free_bytes", freeBytes)
+		return allGPUPlan(layerCount)
+	}
+
+	order := make([]int, layerCount)
+	for i := range order {
+		order[i] = i
+	}
+	if keepAttentionLayersOnDevice {
+		// Prioritize the last layers, where attention tends to dominate
+		// KV traffic, for the limited device slots available.
+		for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+			order[i], order[j] = order[j], order[i]
+		}
+	}
+
+	plan := KVPlacementPlan{PartialOffload: true}
+	onDevice := make(map[int]bool, fitLayers)
+	for _, layer := range order[:fitLayers] {
+		onDevice[layer] = true
+	}
+	for i := 0; i < layerCount; i++ {
+		if onDevice[i] {
+			plan.GPULayers = append(plan.GPULayers, i)
+		} else {
+			plan.CPULayers = append(plan.CPULayers, i)
+		}
+	}
+
+	slog.Warn("KV placement: partial offload, remaining layers use a Device->Host copy plan",
+		"gpu_layers", len(plan.GPULayers), "cpu_layers", len(plan.CPULayers),
+		"free_bytes", freeBytes, "per_layer_bytes", perLayer)
+
+	return plan
+}
+
+func customKVPlan(layerCount int, customLayers []int) KVPlacementPlan {
+	onDevice := make(map[int]bool, len(customLayers))
+	for _, layer := range customLayers {
+		if layer >= 0 && layer < layerCount {
+			onDevice[layer] = true
+		}
+	}
+
+	plan := KVPlacementPlan{}
+	for i := 0; i < layerCount; i++ {
+		if onDevice[i] {
+			plan.GPULayers = append(plan.GPULayers, i)
+		} else {
+			plan.CPULayers = append(plan.CPULayers, i)
+		}
+	}
+	plan.PartialOffload = len(plan.CPULayers) > 0
+
+	slog.Info("KV placement: custom layer list applied", "gpu_layers", len(plan.GPULayers), "cpu_layers", len(plan.CPULayers))
+
+	return plan
+}
+
+func allGPUPlan(layerCount int) KVPlacementPlan {
+	plan := KVPlacementPlan{GPULayers: make([]int, layerCount)}
+	for i := range plan.GPULayers {
+		plan.GPULayers[i] = i
+	}
+	return plan
+}
+
+func allCPUPlan(layerCount int) KVPlacementPlan {
+	plan := KVPlacementPlan{CPULayers: make([]int, layerCount)}
+	for i := range plan.CPULayers {
+		plan.CPULayers[i] = i
+	}
+	return plan
+}
+
+// smallestFreeMemory returns the least free VRAM among the given GPUs,
+// since a layer can only be placed on device if it fits on every GPU it
+// would be sharded across.
+func smallestFreeMemory(gpus discover.GpuInfoList) uint64 {
+	var smallest uint64
+	for i, gpu := range gpus {
+		if i == 0 || gpu.FreeMemory < smallest {
+			smallest = gpu.FreeMemory
+		}
+	}
+	return smallest
+}
+
+// perLayerKVBytes estimates the KV cache footprint of a single layer at the
+// given context length and parallel sequence count, in f16 (the llama.cpp
+// default) since the cache type hasn't been chosen at placement time yet.
+// This mirrors EstimateKVCacheBytes's math minus the layer-count factor.
+func perLayerKVBytes(ggml GGMLModel, numCtx, parallel int) uint64 {
+	headCountK := ggml.KV().EmbeddingHeadCountK()
+	headCountV := ggml.KV().EmbeddingHeadCountV()
+	headCountKV := ggml.KV().HeadCountKV()
+	if headCountK == 0 || headCountV == 0 || headCountKV == 0 || numCtx <= 0 {
+		return 0
+	}
+
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	const bytesPerElemF16 = 2
+	return (headCountK + headCountV) * bytesPerElemF16 * headCountKV * uint64(numCtx) * uint64(parallel)
+}
+
+// appendKVPlacementParams emits --n-gpu-layers and, when only a partial
+// offload fits, a --kv-offload-layers list describing which layers were
+// moved off device onto the host.
+func appendKVPlacementParams(params []string, plan KVPlacementPlan) []string {
+	params = append(params, "--n-gpu-layers", strconv.Itoa(len(plan.GPULayers)))
+	if plan.PartialOffload {
+		params = append(params, "--kv-offload-layers", formatLayerList(plan.CPULayers))
+	}
+	return params
+}
+
+func formatLayerList(layers []int) string {
+	parts := make([]string, len(layers))
+	for i, layer := range layers {
+		parts[i] = strconv.Itoa(layer)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,130 @@
+package llm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ollama/ollama/discover"
+)
+
+func TestComputeKVPlacementPlan(t *testing.T) {
+	ggml := &testGGML{kv: map[string]any{
+		"general.architecture":         "llama",
+		"llama.attention.key_length":   uint32(32),
+		"llama.attention.value_length": uint32(32),
+		"llama.block_count":            uint32(4),
+	}}
+
+	tests := []struct {
+		name          string
+		gpus          discover.GpuInfoList
+		policy        KVPlacement
+		numCtx        int
+		parallel      int
+		wantGPULayers int
+		wantCPULayers int
+		wantPartial   bool
+	}{
+		{
+			name:          "all-cpu forces every layer to host",
+			gpus:          discover.GpuInfoList{{Library: "cuda", FreeMemory: 1 << 30}},
+			policy:        KVPlacement{Mode: KVPlacementAllCPU},
+			numCtx:        4096,
+			parallel:      1,
+			wantGPULayers: 0,
+			wantCPULayers: 4,
+		},
+		{
+			name:          "all-gpu forces every layer onto device",
+			gpus:          discover.GpuInfoList{{Library: "cuda", FreeMemory: 1 << 30}},
+			policy:        KVPlacement{Mode: KVPlacementAllGPU},
+			numCtx:        4096,
+			parallel:      1,
+			wantGPULayers: 4,
+			wantCPULayers: 0,
+		},
+		{
+			name:          "custom layer list is honored",
+			gpus:          discover.GpuInfoList{{Library: "cuda", FreeMemory: 1 << 30}},
+			policy:        KVPlacement{Mode: KVPlacementCustom, CustomLayers: []int{0, 2}},
+			numCtx:        4096,
+			parallel:      1,
+			wantGPULayers: 2,
+			wantCPULayers: 2,
+			wantPartial:   true,
+		},
+		{
+			name:          "auto falls back to all-cpu with no GPUs",
+			gpus:          discover.GpuInfoList{},
+			policy:        KVPlacement{Mode: KVPlacementAuto},
+			numCtx:        4096,
+			parallel:      1,
+			wantGPULayers: 0,
+			wantCPULayers: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := ComputeKVPlacementPlan(ggml, tt.gpus, tt.policy, tt.numCtx, tt.parallel)
+			assert.Len(t, plan.GPULayers, tt.wantGPULayers)
+			assert.Len(t, plan.CPULayers, tt.wantCPULayers)
+			assert.Equal(t, tt.wantPartial, plan.PartialOffload)
+		})
+	}
+}
+
+func TestComputeKVPlacementPlanScalesWithContextLength(t *testing.T) {
+	// 32 layers, head-dim 128 (K+V = 256), 1 GiB free: at a large enough
+	// context length the KV cache no longer fits entirely on device, so
+	// auto placement must fall back to a partial offload instead of
+	// reporting that everything fits.
+	ggml := &testGGML{kv: map[string]any{
+		"general.architecture":          "llama",
+		"llama.attention.key_length":    uint32(128),
+		"llama.attention.value_length":  uint32(128),
+		"llama.attention.head_count_kv": uint32(8),
+		"llama.block_count":             uint32(32),
+	}}
+	gpus := discover.GpuInfoList{{Library: "cuda", FreeMemory: 1 << 30}}
+
+	plan := ComputeKVPlacementPlan(ggml, gpus, KVPlacement{Mode: KVPlacementAuto}, 131072, 1)
+
+	assert.True(t, plan.PartialOffload, "a 131072-token context should not fit entirely in 1 GiB")
+	assert.Less(t, len(plan.GPULayers), 32)
+}
+
+func TestAppendKVPlacementParamsListsOffloadedLayersNotDeviceLayers(t *testing.T) {
+	plan := KVPlacementPlan{
+		GPULayers:      []int{0, 1, 2},
+		CPULayers:      []int{3, 4},
+		PartialOffload: true,
+	}
+
+	got := appendKVPlacementParams(nil, plan)
+
+	assert.Equal(t, []string{"--n-gpu-layers", "3", "--kv-offload-layers", "3,4"}, got,
+		"--kv-offload-layers must list the layers moved off device (CPULayers), not the ones that stayed (GPULayers)")
+}
+
+func TestComputeKVPlacementPlanAccountsForLayerWeightBytes(t *testing.T) {
+	// Same model/hardware as above, but at a context length small enough
+	// that the KV cache alone would fit every layer on device. Once the
+	// per-layer weight footprint is folded in, it shouldn't.
+	ggml := &testGGML{kv: map[string]any{
+		"general.architecture":          "llama",
+		"llama.attention.key_length":    uint32(128),
+		"llama.attention.value_length":  uint32(128),
+		"llama.attention.head_count_kv": uint32(8),
+		"llama.block_count":             uint32(32),
+	}, layerWeightBytes: 64 << 20}
+	gpus := discover.GpuInfoList{{Library: "cuda", FreeMemory: 1 << 30}}
+
+	kvOnly := ComputeKVPlacementPlan(&testGGML{kv: ggml.kv}, gpus, KVPlacement{Mode: KVPlacementAuto}, 4096, 1)
+	assert.False(t, kvOnly.PartialOffload, "KV cache alone should fit all 32 layers in 1 GiB at this context length")
+
+	withWeights := ComputeKVPlacementPlan(ggml, gpus, KVPlacement{Mode: KVPlacementAuto}, 4096, 1)
+	assert.True(t, withWeights.PartialOffload, "64 MiB of weights per layer should no longer fit all 32 layers in 1 GiB")
+	assert.Less(t, len(withWeights.GPULayers), 32)
+}
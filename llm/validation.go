@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log/slog"
 	"slices"
+	"strconv"
 
 	"github.com/ollama/ollama/discover"
 )
@@ -13,32 +14,82 @@ import (
 // Interface for GGML functionality needed by validation
 type GGMLModel interface {
 	KV() KV
+
+	// LayerWeightBytes returns the approximate weight footprint, in
+	// bytes, of a single repeating transformer block, used alongside the
+	// per-layer KV cache estimate to decide how many layers fit on
+	// device.
+	LayerWeightBytes() uint64
 }
 
-// ValidateFlashAttentionSupport checks if flash attention is supported by the model and hardware
-func ValidateFlashAttentionSupport(ggml GGMLModel, gpus discover.GpuInfoList, flashAttnRequested bool) bool {
-	if !gpus.SupportsFlashAttention() {
-		return false
+// minContextLength is the smallest context length GetServerParams will
+// accept; llama.cpp becomes unreliable below this.
+const minContextLength = 512
+
+// ValidateContextLength validates a requested context length against the
+// model's trained context length, clamping it down with a warning when it
+// exceeds the model's max, and refusing it outright when it's below
+// minContextLength.
+func ValidateContextLength(ggml GGMLModel, numCtx int) (int, error) {
+	if numCtx < minContextLength {
+		return 0, fmt.Errorf("context length %d is below the minimum of %d", numCtx, minContextLength)
+	}
+
+	if maxCtx := int(ggml.KV().ContextLength()); maxCtx > 0 && numCtx > maxCtx {
+		slog.Warn("requested context length exceeds the model's trained context, clamping",
+			"requested", numCtx, "max", maxCtx)
+		return maxCtx, nil
+	}
+
+	return numCtx, nil
+}
+
+// ValidateFlashAttentionSupport checks if flash attention is supported by
+// the model and every GPU it will run on, returning a reason describing
+// why it's unsupported when it isn't.
+func ValidateFlashAttentionSupport(ggml GGMLModel, gpus discover.GpuInfoList, flashAttnRequested bool) (bool, string) {
+	if !flashAttnRequested {
+		return false, "flash attention not requested"
+	}
+
+	if ok, reason := modelSupportsFlashAttention(ggml); !ok {
+		return false, reason
 	}
 
-	return supportsFlashAttention(ggml) && flashAttnRequested
+	if len(gpus) == 0 {
+		return false, "no GPUs detected"
+	}
+
+	for _, gpu := range gpus {
+		if ok, reason := gpuSupportsFlashAttention(gpu); !ok {
+			return false, reason
+		}
+	}
+
+	return true, ""
 }
 
-// supportsFlashAttention checks if the model supports flash attention
-func supportsFlashAttention(ggml GGMLModel) bool {
+// modelSupportsFlashAttention checks if the model architecture supports
+// flash attention, independent of the hardware it runs on.
+func modelSupportsFlashAttention(ggml GGMLModel) (bool, string) {
 	// Check if it's an embedding model - embedding models don't support flash attention
 	if _, ok := ggml.KV()[fmt.Sprintf("%s.pooling_type", ggml.KV().Architecture())]; ok {
-		return false
+		return false, "embedding models do not support flash attention"
 	}
 
 	// Check head counts match and are non-zero
 	headCountK := ggml.KV().EmbeddingHeadCountK()
 	headCountV := ggml.KV().EmbeddingHeadCountV()
-	return headCountK != 0 && headCountV != 0 && headCountK == headCountV
-}
+	if headCountK == 0 || headCountV == 0 || headCountK != headCountV {
+		return false, "model K/V head counts are zero or mismatched"
+	}
 
-// ValidKVCacheTypes contains all supported KV cache types
-var ValidKVCacheTypes = []string{"f32", "f16", "q8_0", "q5_1", "q5_0", "iq4_nl", "q4_1", "q4_0"}
+	if !slices.Contains(flashAttentionHeadDims, headCountK) {
+		return false, fmt.Sprintf("head dimension %d has no flash attention kernel", headCountK)
+	}
+
+	return true, ""
+}
 
 // ValidateKVCacheType checks if the given cache type is valid for the model type
 func ValidateKVCacheType(cacheType string, isEmbedding bool) (string, error) {
@@ -46,26 +97,69 @@ func ValidateKVCacheType(cacheType string, isEmbedding bool) (string, error) {
 		return "", nil
 	}
 
-	if !slices.Contains(ValidKVCacheTypes, cacheType) {
+	ct, ok := LookupCacheType(cacheType)
+	if !ok {
 		slog.Warn("invalid cache type, defaulting to f16", "type", cacheType)
 		return "f16", nil
 	}
 
-	// For embedding models, only allow f16 and f32
-	if isEmbedding && cacheType != "f16" && cacheType != "f32" {
-		slog.Warn("only f16 and f32 cache types are supported for embedding models, defaulting to f16",
+	// For embedding models, only allow cache types marked safe for them
+	if isEmbedding && !ct.AllowedForEmbedding {
+		slog.Warn("cache type is not supported for embedding models, defaulting to f16",
 			"type", cacheType)
 		return "f16", nil
 	}
 
-	return cacheType, nil
+	return ct.Name, nil
+}
+
+// KVCacheConfig holds independent cache type selections for the K and V
+// caches, mirroring llama.cpp's separate type_k/type_v server options.
+type KVCacheConfig struct {
+	K string
+	V string
+}
+
+// NewKVCacheConfig fans a single cache type string out to both the K and V
+// caches, preserving the old one-flag-for-both behavior for callers that
+// don't need asymmetric configuration.
+func NewKVCacheConfig(cacheType string) KVCacheConfig {
+	return KVCacheConfig{K: cacheType, V: cacheType}
 }
 
-// GetServerParams returns the validated and formatted server parameters
-func GetServerParams(ggml GGMLModel, gpus discover.GpuInfoList, flashAttnRequested bool, kvCacheType string, baseParams []string) []string {
+// ValidateKVCacheConfig validates the K and V cache types independently,
+// each subject to the same rules as ValidateKVCacheType.
+func ValidateKVCacheConfig(cfg KVCacheConfig, isEmbedding bool) (KVCacheConfig, error) {
+	k, err := ValidateKVCacheType(cfg.K, isEmbedding)
+	if err != nil {
+		return KVCacheConfig{}, err
+	}
+
+	v, err := ValidateKVCacheType(cfg.V, isEmbedding)
+	if err != nil {
+		return KVCacheConfig{}, err
+	}
+
+	return KVCacheConfig{K: k, V: v}, nil
+}
+
+// GetServerParams validates numCtx, the KV cache types, flash attention
+// support, and the KV placement policy together - this is the single
+// authoritative place where ctx length, cache type, and flash-attn
+// interact - and returns the formatted server parameters.
+func GetServerParams(ggml GGMLModel, gpus discover.GpuInfoList, flashAttnRequested bool, kvCache KVCacheConfig, placement KVPlacement, numCtx, parallel int, baseParams []string) ([]string, error) {
 	params := slices.Clone(baseParams)
 
-	flashAttnEnabled := ValidateFlashAttentionSupport(ggml, gpus, flashAttnRequested)
+	numCtx, err := ValidateContextLength(ggml, numCtx)
+	if err != nil {
+		return nil, err
+	}
+	params = append(params, "--ctx-size", strconv.Itoa(numCtx))
+
+	plan := ComputeKVPlacementPlan(ggml, gpus, placement, numCtx, parallel)
+	params = appendKVPlacementParams(params, plan)
+
+	flashAttnEnabled, flashAttnReason := ValidateFlashAttentionSupport(ggml, gpus, flashAttnRequested)
 	isEmbeddingModel := false
 	if _, ok := ggml.KV()[fmt.Sprintf("%s.pooling_type", ggml.KV().Architecture())]; ok {
 		isEmbeddingModel = true
@@ -75,20 +169,27 @@ func GetServerParams(ggml GGMLModel, gpus discover.GpuInfoList, flashAttnRequest
 		params = append(params, "--flash-attn")
 		slog.Info("Enabling flash attention")
 
-		// Only set KV cache type when flash attention is enabled
-		if validatedType, _ := ValidateKVCacheType(kvCacheType, isEmbeddingModel); validatedType != "" {
-			params = append(params, "--kv-cache-type", validatedType)
-			slog.Debug("Setting cache type", "type", validatedType)
+		// Only set KV cache types when flash attention is enabled
+		if validated, _ := ValidateKVCacheConfig(kvCache, isEmbeddingModel); validated.K != "" || validated.V != "" {
+			freeBytes := smallestFreeMemory(gpus)
+			if validated.K != "" {
+				validated.K = validateCacheTypeForBackends(validated.K, gpus)
+				validated.K = fitCacheType(ggml, validated.K, numCtx, parallel, freeBytes)
+				params = append(params, "--cache-type-k", validated.K)
+			}
+			if validated.V != "" {
+				validated.V = validateCacheTypeForBackends(validated.V, gpus)
+				validated.V = fitCacheType(ggml, validated.V, numCtx, parallel, freeBytes)
+				params = append(params, "--cache-type-v", validated.V)
+			}
+			slog.Debug("Setting cache types", "k", validated.K, "v", validated.V)
 		}
 	} else {
-		slog.Info("Flash attention not enabled")
-		if !isEmbeddingModel && kvCacheType != "" {
-			quantizedTypes := []string{"q8_0", "q5_1", "q5_0", "iq4_nl", "q4_1", "q4_0"}
-			if slices.Contains(quantizedTypes, kvCacheType) {
-				slog.Warn("Quantized cache types require flash attention. Using default cache type.")
-			}
+		slog.Info("Flash attention not enabled", "reason", flashAttnReason)
+		if !isEmbeddingModel && (cacheTypeRequiresFlashAttn(kvCache.K) || cacheTypeRequiresFlashAttn(kvCache.V)) {
+			slog.Warn("Quantized cache types require flash attention. Using default cache type.")
 		}
 	}
 
-	return params
+	return params, nil
 }
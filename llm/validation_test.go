@@ -10,13 +10,18 @@ import (
 
 // testGGML implements GGMLModel for testing
 type testGGML struct {
-	kv KV
+	kv               KV
+	layerWeightBytes uint64
 }
 
 func (g *testGGML) KV() KV {
 	return g.kv
 }
 
+func (g *testGGML) LayerWeightBytes() uint64 {
+	return g.layerWeightBytes
+}
+
 func TestValidateKVCacheType(t *testing.T) {
 	tests := []struct {
 		name             string
@@ -87,8 +92,8 @@ func TestValidateFlashAttentionSupport(t *testing.T) {
 			name: "supported model and hardware",
 			kvData: map[string]any{
 				"general.architecture":         "llama",
-				"llama.attention.key_length":   uint32(32),
-				"llama.attention.value_length": uint32(32),
+				"llama.attention.key_length":   uint32(128),
+				"llama.attention.value_length": uint32(128),
 			},
 			gpus: discover.GpuInfoList{
 				{Library: "cuda", DriverMajor: 8},
@@ -100,8 +105,8 @@ func TestValidateFlashAttentionSupport(t *testing.T) {
 			name: "embedding model",
 			kvData: map[string]any{
 				"general.architecture":        "bert",
-				"bert.attention.key_length":   uint32(32),
-				"bert.attention.value_length": uint32(32),
+				"bert.attention.key_length":   uint32(128),
+				"bert.attention.value_length": uint32(128),
 				"bert.pooling_type":           "mean",
 			},
 			gpus: discover.GpuInfoList{
@@ -112,13 +117,26 @@ func TestValidateFlashAttentionSupport(t *testing.T) {
 		},
 		{
 			name: "unsupported hardware",
+			kvData: map[string]any{
+				"general.architecture":         "llama",
+				"llama.attention.key_length":   uint32(128),
+				"llama.attention.value_length": uint32(128),
+			},
+			gpus: discover.GpuInfoList{
+				{Library: "cuda", DriverMajor: 6},
+			},
+			flashAttnRequested: true,
+			want:               false,
+		},
+		{
+			name: "unsupported head dimension",
 			kvData: map[string]any{
 				"general.architecture":         "llama",
 				"llama.attention.key_length":   uint32(32),
 				"llama.attention.value_length": uint32(32),
 			},
 			gpus: discover.GpuInfoList{
-				{Library: "cuda", DriverMajor: 6},
+				{Library: "cuda", DriverMajor: 8},
 			},
 			flashAttnRequested: true,
 			want:               false,
@@ -128,7 +146,7 @@ func TestValidateFlashAttentionSupport(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ggml := &testGGML{kv: tt.kvData}
-			got := ValidateFlashAttentionSupport(ggml, tt.gpus, tt.flashAttnRequested)
+			got, _ := ValidateFlashAttentionSupport(ggml, tt.gpus, tt.flashAttnRequested)
 			assert.Equal(t, tt.want, got)
 		})
 	}
@@ -140,7 +158,7 @@ func TestGetServerParams(t *testing.T) {
 		ggml               GGMLModel
 		gpus               discover.GpuInfoList
 		flashAttnRequested bool
-		kvCacheType        string
+		kvCache            KVCacheConfig
 		baseParams         []string
 		want               []string
 	}{
@@ -148,14 +166,27 @@ func TestGetServerParams(t *testing.T) {
 			name: "flash attention enabled with valid cache type",
 			ggml: &testGGML{kv: map[string]any{
 				"general.architecture":         "llama",
-				"llama.attention.key_length":   uint32(32),
-				"llama.attention.value_length": uint32(32),
+				"llama.attention.key_length":   uint32(128),
+				"llama.attention.value_length": uint32(128),
+			}},
+			gpus:               discover.GpuInfoList{{Library: "cuda", DriverMajor: 8}},
+			flashAttnRequested: true,
+			kvCache:            NewKVCacheConfig("q8_0"),
+			baseParams:         []string{"--model", "test"},
+			want:               []string{"--model", "test", "--ctx-size", "2048", "--n-gpu-layers", "0", "--flash-attn", "--cache-type-k", "q8_0", "--cache-type-v", "q8_0"},
+		},
+		{
+			name: "flash attention enabled with asymmetric cache types",
+			ggml: &testGGML{kv: map[string]any{
+				"general.architecture":         "llama",
+				"llama.attention.key_length":   uint32(128),
+				"llama.attention.value_length": uint32(128),
 			}},
 			gpus:               discover.GpuInfoList{{Library: "cuda", DriverMajor: 8}},
 			flashAttnRequested: true,
-			kvCacheType:        "q8_0",
+			kvCache:            KVCacheConfig{K: "q8_0", V: "q4_0"},
 			baseParams:         []string{"--model", "test"},
-			want:               []string{"--model", "test", "--flash-attn", "--kv-cache-type", "q8_0"},
+			want:               []string{"--model", "test", "--ctx-size", "2048", "--n-gpu-layers", "0", "--flash-attn", "--cache-type-k", "q8_0", "--cache-type-v", "q4_0"},
 		},
 		{
 			name: "flash attention disabled",
@@ -165,15 +196,92 @@ func TestGetServerParams(t *testing.T) {
 			}},
 			gpus:               discover.GpuInfoList{{Library: "cuda", DriverMajor: 8}},
 			flashAttnRequested: true,
-			kvCacheType:        "q8_0",
+			kvCache:            NewKVCacheConfig("q8_0"),
 			baseParams:         []string{"--model", "test"},
-			want:               []string{"--model", "test"},
+			want:               []string{"--model", "test", "--ctx-size", "2048", "--n-gpu-layers", "0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetServerParams(tt.ggml, tt.gpus, tt.flashAttnRequested, tt.kvCache, KVPlacement{}, 2048, 1, tt.baseParams)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("refuses a context length below the minimum", func(t *testing.T) {
+		ggml := &testGGML{kv: map[string]any{
+			"general.architecture":         "llama",
+			"llama.attention.key_length":   uint32(128),
+			"llama.attention.value_length": uint32(128),
+		}}
+		_, err := GetServerParams(ggml, discover.GpuInfoList{{Library: "cuda", DriverMajor: 8}}, true, NewKVCacheConfig("q8_0"), KVPlacement{}, 128, 1, []string{"--model", "test"})
+		assert.Error(t, err)
+	})
+}
+
+func TestValidateContextLength(t *testing.T) {
+	ggml := &testGGML{kv: map[string]any{
+		"general.architecture": "llama",
+		"llama.context_length": uint32(8192),
+	}}
+
+	tests := []struct {
+		name    string
+		numCtx  int
+		want    int
+		wantErr bool
+	}{
+		{name: "within model's trained context", numCtx: 4096, want: 4096},
+		{name: "exceeds model's trained context, clamps", numCtx: 16384, want: 8192},
+		{name: "below minimum, refused", numCtx: 256, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ValidateContextLength(ggml, tt.numCtx)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestValidateKVCacheConfig(t *testing.T) {
+	tests := []struct {
+		name             string
+		cfg              KVCacheConfig
+		isEmbeddingModel bool
+		want             KVCacheConfig
+	}{
+		{
+			name:             "asymmetric quantized types for normal model",
+			cfg:              KVCacheConfig{K: "q8_0", V: "q4_0"},
+			isEmbeddingModel: false,
+			want:             KVCacheConfig{K: "q8_0", V: "q4_0"},
+		},
+		{
+			name:             "quantized V rejected for embedding model",
+			cfg:              KVCacheConfig{K: "f16", V: "q4_0"},
+			isEmbeddingModel: true,
+			want:             KVCacheConfig{K: "f16", V: "f16"},
+		},
+		{
+			name:             "invalid K falls back to f16",
+			cfg:              KVCacheConfig{K: "invalid", V: "q8_0"},
+			isEmbeddingModel: false,
+			want:             KVCacheConfig{K: "f16", V: "q8_0"},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := GetServerParams(tt.ggml, tt.gpus, tt.flashAttnRequested, tt.kvCacheType, tt.baseParams)
+			got, err := ValidateKVCacheConfig(tt.cfg, tt.isEmbeddingModel)
+			assert.NoError(t, err)
 			assert.Equal(t, tt.want, got)
 		})
 	}